@@ -6,16 +6,123 @@ package main
 
 import (
 	"context"
-	"io/ioutil"
+	"flag"
+	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
 )
 
+// This revision assumes the snippet type (defined in snippet.go) carries
+// CreatedAt and ExpiresAt time.Time fields alongside Body. How much of them
+// a backend keeps differs: cloudDatastore and inMemStore store and return
+// both; filesystemStore keeps ExpiresAt only; redisStore turns ExpiresAt
+// into a key TTL; sqlStore writes both columns. The redis and sql
+// GetSnippet return the body only.
+
+// maxBodyBytes bounds the size of a snippet body accepted by PutSnippet,
+// enforced by every backend so a single oversized paste can't blow up
+// datastore costs or disk usage.
+var maxBodyBytes = flag.Int64("max-body-bytes", 1<<20,
+	"maximum snippet body size in bytes; larger PUTs are rejected with ErrSnippetTooLarge")
+
+// ErrSnippetTooLarge is returned by PutSnippet when snip.Body exceeds
+// -max-body-bytes.
+type ErrSnippetTooLarge struct {
+	MaxBytes int64
+}
+
+func (e *ErrSnippetTooLarge) Error() string {
+	return fmt.Sprintf("snippet body exceeds maximum of %d bytes", e.MaxBytes)
+}
+
+func checkBodySize(snip *snippet) error {
+	if int64(len(snip.Body)) > *maxBodyBytes {
+		return &ErrSnippetTooLarge{MaxBytes: *maxBodyBytes}
+	}
+	return nil
+}
+
+// snippetMeta carries request-scoped information about who is storing a
+// snippet, so a store can apply per-client policy (e.g. abuse quotas)
+// without server.go reaching into storage internals.
+type snippetMeta struct {
+	RemoteIP  string
+	UserAgent string
+}
+
+// storeBackend selects which store implementation newStore returns. It
+// defaults to PLAYGROUND_STORE so operators can configure the backend
+// without touching flags, e.g. when running behind systemd.
+var storeBackend = flag.String("store", envOr("PLAYGROUND_STORE", "datastore"),
+	"storage backend to use: memory, filesystem, datastore, redis, or sql")
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// newStore builds the store selected by the -store flag (or
+// PLAYGROUND_STORE env var). It keeps the existing cloudDatastore path as
+// the default so deployments on GCP need no changes. cloudDatastore and
+// filesystemStore are wrapped in the in-memory LRU cache by default, since
+// both have backend round-trips worth avoiding on repeated GETs.
+func newStore(ctx context.Context) (store, error) {
+	s, err := newBackendStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newAbuseLimitStore(s, *putRateLimit, *putRateBurst), nil
+}
+
+// newBackendStore builds the backend selected by -store, without the
+// abuse-limiting wrapper newStore adds on top.
+func newBackendStore(ctx context.Context) (store, error) {
+	switch *storeBackend {
+	case "memory":
+		return newInMemStore(), nil
+	case "filesystem":
+		fs, err := newFilesystemStore()
+		if err != nil {
+			return nil, err
+		}
+		return newCachingStore(fs, *cacheSize, *cacheTTL)
+	case "datastore", "":
+		client, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			return nil, fmt.Errorf("creating datastore client: %v", err)
+		}
+		return newCachingStore(cloudDatastore{client: client}, *cacheSize, *cacheTTL)
+	case "redis":
+		return newRedisStore()
+	case "sql":
+		return newSQLStore()
+	default:
+		return nil, fmt.Errorf("unknown -store %q: want memory, filesystem, datastore, redis, or sql", *storeBackend)
+	}
+}
+
 type store interface {
 	PutSnippet(ctx context.Context, id string, snip *snippet) error
+	// PutSnippetWithMeta is like PutSnippet but also reports who is making
+	// the request, so a store wrapped in a rate limiter (see
+	// newAbuseLimitStore) can reject prolific abusers before hitting
+	// storage. Backends that don't rate-limit just ignore meta.
+	PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, meta snippetMeta) error
 	GetSnippet(ctx context.Context, id string, snip *snippet) error
+	DeleteSnippet(ctx context.Context, id string) error
+	// IterateSnippets calls fn once per stored snippet, in backend-defined
+	// order, for use by admin tooling. Iteration stops at the first error
+	// returned by fn.
+	IterateSnippets(ctx context.Context, fn func(id string, snip *snippet) error) error
+	// Close releases any resources (file locks, connections) held by the
+	// store. main calls it during graceful shutdown.
+	Close() error
 }
 
 type cloudDatastore struct {
@@ -23,34 +130,148 @@ type cloudDatastore struct {
 }
 
 func (s cloudDatastore) PutSnippet(ctx context.Context, id string, snip *snippet) error {
+	if err := checkBodySize(snip); err != nil {
+		return err
+	}
 	key := datastore.NameKey("Snippet", id, nil)
 	_, err := s.client.Put(ctx, key, snip)
 	return err
 }
 
+func (s cloudDatastore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, _ snippetMeta) error {
+	return s.PutSnippet(ctx, id, snip)
+}
+
+// datastoreDeleteMultiLimit is the maximum number of entities Cloud
+// Datastore accepts in a single commit.
+const datastoreDeleteMultiLimit = 500
+
+// sweepExpired deletes all snippets whose ExpiresAt has passed, using a
+// KeysOnly query so the sweep doesn't pull snippet bodies over the wire.
+// Keys are deleted in batches of datastoreDeleteMultiLimit, since a
+// single DeleteMulti call is capped at 500 entities and a backlog larger
+// than that would otherwise fail the whole sweep instead of making
+// partial progress. Intended to be invoked periodically by a cron job,
+// matching how other GAE maintenance tasks in this project run.
+func (s cloudDatastore) sweepExpired(ctx context.Context) error {
+	q := datastore.NewQuery("Snippet").
+		Filter("ExpiresAt >", time.Time{}).
+		Filter("ExpiresAt <=", time.Now()).
+		KeysOnly()
+	keys, err := s.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := datastoreDeleteMultiLimit
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := s.client.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
 func (s cloudDatastore) GetSnippet(ctx context.Context, id string, snip *snippet) error {
 	key := datastore.NameKey("Snippet", id, nil)
 	return s.client.Get(ctx, key, snip)
 }
 
+func (s cloudDatastore) DeleteSnippet(ctx context.Context, id string) error {
+	key := datastore.NameKey("Snippet", id, nil)
+	return s.client.Delete(ctx, key)
+}
+
+func (s cloudDatastore) IterateSnippets(ctx context.Context, fn func(id string, snip *snippet) error) error {
+	it := s.client.Run(ctx, datastore.NewQuery("Snippet"))
+	for {
+		var snip snippet
+		key, err := it.Next(&snip)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key.Name, &snip); err != nil {
+			return err
+		}
+	}
+}
+
+func (s cloudDatastore) Close() error {
+	return s.client.Close()
+}
+
 // inMemStore is a store backed by a map that should only be used for testing.
 type inMemStore struct {
 	sync.RWMutex
 	m map[string]*snippet // key -> snippet
+
+	stopSweep chan struct{}
+}
+
+// newInMemStore starts the hourly expiration sweeper and returns a ready
+// to use inMemStore. Tests that don't care about expiration can still use
+// the zero value &inMemStore{} directly.
+func newInMemStore() *inMemStore {
+	s := &inMemStore{stopSweep: make(chan struct{})}
+	go s.sweepLoop()
+	return s
+}
+
+func (s *inMemStore) sweepLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweepExpired()
+		case <-s.stopSweep:
+			return
+		}
+	}
+}
+
+func (s *inMemStore) sweepExpired() {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for id, snip := range s.m {
+		if !snip.ExpiresAt.IsZero() && snip.ExpiresAt.Before(now) {
+			delete(s.m, id)
+		}
+	}
 }
 
 func (s *inMemStore) PutSnippet(_ context.Context, id string, snip *snippet) error {
+	if err := checkBodySize(snip); err != nil {
+		return err
+	}
 	s.Lock()
 	if s.m == nil {
 		s.m = map[string]*snippet{}
 	}
 	b := make([]byte, len(snip.Body))
 	copy(b, snip.Body)
-	s.m[id] = &snippet{Body: b}
+	stored := *snip
+	stored.Body = b
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	s.m[id] = &stored
 	s.Unlock()
 	return nil
 }
 
+func (s *inMemStore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, _ snippetMeta) error {
+	return s.PutSnippet(ctx, id, snip)
+}
+
 func (s *inMemStore) GetSnippet(_ context.Context, id string, snip *snippet) error {
 	s.RLock()
 	defer s.RUnlock()
@@ -62,44 +283,27 @@ func (s *inMemStore) GetSnippet(_ context.Context, id string, snip *snippet) err
 	return nil
 }
 
-// filesystemStore is a store backed by a map that should only be used for filesystem.
-// add by polairs, at 2020-03-04
-type filesystemStore struct {
-	storePath string
-	sync.RWMutex
-	m map[string]*snippet // key -> snippet
-}
-
-func newFilesystemStore() *filesystemStore {
-	storePath := "./snippet"
-	if err := os.MkdirAll(storePath, 0755); err != nil {
-		panic(err)
-	}
-
-	return &filesystemStore{storePath: storePath}
+func (s *inMemStore) DeleteSnippet(_ context.Context, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, id)
+	return nil
 }
 
-func (f *filesystemStore) PutSnippet(_ context.Context, id string, snip *snippet) error {
-	filePath := f.storePath + "/" + id[:2]
-	os.Mkdir(filePath, 0755)
-	file, err := os.Create(filePath + "/" + id)
-	if err != nil {
-		log.Errorf("create snip file error:%#v", err)
-		return err
+func (s *inMemStore) IterateSnippets(_ context.Context, fn func(id string, snip *snippet) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	for id, snip := range s.m {
+		if err := fn(id, snip); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
-	file.Write(snip.Body)
-
 	return nil
 }
 
-func (f *filesystemStore) GetSnippet(_ context.Context, id string, snip *snippet) error {
-	body, err := ioutil.ReadFile(f.storePath + "/" + id[:2] + "/" + id)
-	if err != nil {
-		return datastore.ErrNoSuchEntity
+func (s *inMemStore) Close() error {
+	if s.stopSweep != nil {
+		close(s.stopSweep)
 	}
-
-	snip.Body = body
-
 	return nil
 }
@@ -0,0 +1,142 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	cacheSize = flag.Int("cache-size", 10000,
+		"number of snippets to keep in the in-memory cache in front of the store; 0 disables caching")
+	cacheTTL = flag.Duration("cache-ttl", 10*time.Minute,
+		"how long a cached snippet stays fresh before a GET re-fetches it from the backend store")
+)
+
+var (
+	cacheRegistry = prometheus.NewRegistry()
+
+	cacheHits = promauto.With(cacheRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "snippet_cache_hits_total",
+		Help: "Number of GetSnippet calls served from the in-memory cache.",
+	})
+	cacheMisses = promauto.With(cacheRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "snippet_cache_misses_total",
+		Help: "Number of GetSnippet calls that missed the in-memory cache and fetched from the backend store.",
+	})
+	backendLatency = promauto.With(cacheRegistry).NewHistogram(prometheus.HistogramOpts{
+		Name: "snippet_backend_latency_seconds",
+		Help: "Latency of GetSnippet calls against the backend store, excluding cache hits.",
+	})
+)
+
+// registerStoreDebugHandler registers the /debug/store metrics endpoint.
+// main calls this once at startup, alongside its other /debug handlers.
+func registerStoreDebugHandler(mux *http.ServeMux) {
+	mux.Handle("/debug/store", promhttp.HandlerFor(cacheRegistry, promhttp.HandlerOpts{}))
+}
+
+type cacheEntry struct {
+	snip     snippet
+	storedAt time.Time
+}
+
+// cachingStore wraps a store with a bounded, write-through LRU cache so
+// repeated GETs for a popular snippet - a shared link going viral is the
+// common case on the playground - don't hit datastore/disk on every
+// request. Concurrent misses for the same id collapse into a single
+// backend fetch via singleflight.
+type cachingStore struct {
+	backend store
+	cache   *lru.Cache
+	ttl     time.Duration
+	group   singleflight.Group
+}
+
+// newCachingStore wraps backend in an LRU cache of the given size. A size
+// of 0 disables caching and newCachingStore returns backend unchanged.
+func newCachingStore(backend store, size int, ttl time.Duration) (store, error) {
+	if size <= 0 {
+		return backend, nil
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingStore{backend: backend, cache: cache, ttl: ttl}, nil
+}
+
+func (c *cachingStore) PutSnippet(ctx context.Context, id string, snip *snippet) error {
+	if err := c.backend.PutSnippet(ctx, id, snip); err != nil {
+		return err
+	}
+	c.cache.Add(id, cacheEntry{snip: *snip, storedAt: time.Now()})
+	return nil
+}
+
+func (c *cachingStore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, meta snippetMeta) error {
+	if err := c.backend.PutSnippetWithMeta(ctx, id, snip, meta); err != nil {
+		return err
+	}
+	c.cache.Add(id, cacheEntry{snip: *snip, storedAt: time.Now()})
+	return nil
+}
+
+// GetSnippet may serve a cached snippet for up to c.ttl after it was
+// deleted upstream (by DeleteSnippet on another process, or a backend
+// sweep), since this cache only learns of a delete through its own
+// DeleteSnippet method or TTL expiry, not by watching the backend.
+func (c *cachingStore) GetSnippet(ctx context.Context, id string, snip *snippet) error {
+	if v, ok := c.cache.Get(id); ok {
+		entry := v.(cacheEntry)
+		if c.ttl == 0 || time.Since(entry.storedAt) < c.ttl {
+			cacheHits.Inc()
+			*snip = entry.snip
+			return nil
+		}
+		c.cache.Remove(id)
+	}
+	cacheMisses.Inc()
+
+	v, err, _ := c.group.Do(id, func() (interface{}, error) {
+		var fetched snippet
+		start := time.Now()
+		err := c.backend.GetSnippet(ctx, id, &fetched)
+		backendLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			return nil, err
+		}
+		c.cache.Add(id, cacheEntry{snip: fetched, storedAt: time.Now()})
+		return fetched, nil
+	})
+	if err != nil {
+		return err
+	}
+	*snip = v.(snippet)
+	return nil
+}
+
+func (c *cachingStore) DeleteSnippet(ctx context.Context, id string) error {
+	err := c.backend.DeleteSnippet(ctx, id)
+	c.cache.Remove(id)
+	return err
+}
+
+func (c *cachingStore) IterateSnippets(ctx context.Context, fn func(id string, snip *snippet) error) error {
+	return c.backend.IterateSnippets(ctx, fn)
+}
+
+func (c *cachingStore) Close() error {
+	return c.backend.Close()
+}
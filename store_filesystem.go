@@ -0,0 +1,541 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/klauspost/compress/zstd"
+)
+
+// filesystemStore is a store backed by a content-addressed object layout
+// on disk: snippets are deduplicated by the SHA-256 of their body, and the
+// id -> hash mapping is kept in a small append-only index.
+//
+// add by polairs, at 2020-03-04
+type filesystemStore struct {
+	storePath   string
+	objectsPath string
+	lockFile    *os.File // holds the process-wide advisory lock on storePath
+	writeLock   shardedMutex
+	objectLock  shardedMutex
+
+	indexMu             sync.RWMutex
+	index               map[string]indexEntry // snippet id -> body hash + expiry
+	idxFile             *os.File               // append-only log backing index
+	indexPath           string                 // path backing idxFile, for compaction rewrites
+	dirty               bool                   // true if idxFile has unflushed appends
+	appendsSinceCompact int                    // lines appended since the log was last compacted
+
+	stopSweep chan struct{}
+}
+
+// indexEntry is the in-memory record for one snippet id: which content
+// object it points at, and when (if ever) it should be swept away.
+type indexEntry struct {
+	hash      string
+	expiresAt time.Time // zero means no expiration
+}
+
+// shardedMutex is a set of 256 mutexes picked by the first byte of a key,
+// so concurrent operations on different keys don't serialize on a single
+// global lock.
+type shardedMutex [256]sync.Mutex
+
+func (s *shardedMutex) Lock(key string)   { s[key[0]].Lock() }
+func (s *shardedMutex) Unlock(key string) { s[key[0]].Unlock() }
+
+const objectHeaderLen = 5 // 1 byte compression format + 4 byte CRC32
+
+// indexSyncInterval bounds how long a PutSnippet/DeleteSnippet can sit
+// unflushed before fsyncIndexLoop durably commits it. Batching the fsync
+// this way, instead of doing it inline under indexMu on every write,
+// keeps concurrent PUTs for different snippets from serializing on one
+// global fsync and undercutting the per-id sharded writeLock above.
+const indexSyncInterval = 200 * time.Millisecond
+
+// indexCompactionThreshold triggers a rewrite of the index log once the
+// number of appended lines since the last compaction grows to this many
+// times the number of live entries, so the log - and the replay
+// loadIndex does on every startup - stays roughly proportional to the
+// data it describes instead of growing without bound across
+// Puts/Deletes/sweeps.
+const indexCompactionThreshold = 4
+
+const (
+	formatZstd byte = 'z'
+	formatGzip byte = 'g'
+)
+
+func newFilesystemStore() (*filesystemStore, error) {
+	storePath := "./snippet"
+	objectsPath := filepath.Join(storePath, "objects")
+	if err := os.MkdirAll(objectsPath, 0755); err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(storePath, "LOCK"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening store lock file: %v", err)
+	}
+	if err := lockFileExclusive(lockFile); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("acquiring lock on %s (is another playground process using this store?): %v", storePath, err)
+	}
+
+	indexPath := filepath.Join(storePath, "index")
+	index, idxFile, err := loadIndex(indexPath)
+	if err != nil {
+		unlockFile(lockFile)
+		lockFile.Close()
+		return nil, err
+	}
+
+	fs := &filesystemStore{
+		storePath:   storePath,
+		objectsPath: objectsPath,
+		lockFile:    lockFile,
+		index:       index,
+		idxFile:     idxFile,
+		indexPath:   indexPath,
+		stopSweep:   make(chan struct{}),
+	}
+	go fs.sweepLoop()
+	go fs.fsyncIndexLoop()
+	return fs, nil
+}
+
+// loadIndex replays the append-only index log into memory and returns it
+// along with the file reopened for appending. Each line is
+// "id\thash\texpiresAtUnix\n"; a blank hash records a deletion, and an
+// expiresAtUnix of 0 means the snippet never expires.
+func loadIndex(path string) (map[string]indexEntry, *os.File, error) {
+	index := map[string]indexEntry{}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "\t", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			id, hash, expiresRaw := parts[0], parts[1], parts[2]
+			if hash == "" {
+				delete(index, id)
+				continue
+			}
+			var expiresAt time.Time
+			if secs, err := strconv.ParseInt(expiresRaw, 10, 64); err == nil && secs != 0 {
+				expiresAt = time.Unix(secs, 0)
+			}
+			index[id] = indexEntry{hash: hash, expiresAt: expiresAt}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, fmt.Errorf("reading index: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("opening index: %v", err)
+	}
+
+	idxFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening index for append: %v", err)
+	}
+	return index, idxFile, nil
+}
+
+// recordIndex appends an id -> hash mapping (or, if hash is "", a
+// deletion tombstone) to the index log and updates the in-memory copy.
+// The append is durably committed by fsyncIndexLoop rather than fsynced
+// inline here, so this only serializes on indexMu for as long as the
+// write(2) call takes, not a Sync(2) - see indexSyncInterval. The
+// exception is an append that triggers compactIndex, which holds indexMu
+// across the fsync of the rewritten log.
+func (f *filesystemStore) recordIndex(id, hash string, expiresAt time.Time) error {
+	f.indexMu.Lock()
+	var expiresRaw int64
+	if !expiresAt.IsZero() {
+		expiresRaw = expiresAt.Unix()
+	}
+	if _, err := fmt.Fprintf(f.idxFile, "%s\t%s\t%d\n", id, hash, expiresRaw); err != nil {
+		f.indexMu.Unlock()
+		return err
+	}
+	if hash == "" {
+		delete(f.index, id)
+	} else {
+		f.index[id] = indexEntry{hash: hash, expiresAt: expiresAt}
+	}
+	f.dirty = true
+	f.appendsSinceCompact++
+	needCompact := f.appendsSinceCompact > indexCompactionThreshold*(len(f.index)+1)
+	f.indexMu.Unlock()
+
+	if needCompact {
+		if err := f.compactIndex(); err != nil {
+			log.Errorf("store_filesystem: compacting index: %#v", err)
+		}
+	}
+	return nil
+}
+
+// fsyncIndexLoop periodically commits appends made by recordIndex to
+// disk, bounding the durability window to indexSyncInterval instead of
+// fsyncing (and serializing PUTs) on every single write.
+func (f *filesystemStore) fsyncIndexLoop() {
+	ticker := time.NewTicker(indexSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.flushIndex()
+		case <-f.stopSweep:
+			return
+		}
+	}
+}
+
+// flushIndex fsyncs the index log if recordIndex has appended to it
+// since the last flush.
+func (f *filesystemStore) flushIndex() {
+	f.indexMu.Lock()
+	dirty := f.dirty
+	f.dirty = false
+	f.indexMu.Unlock()
+	if !dirty {
+		return
+	}
+	if err := f.idxFile.Sync(); err != nil {
+		log.Errorf("store_filesystem: fsyncing index: %#v", err)
+	}
+}
+
+// compactIndex rewrites the index log to hold exactly one line per live
+// entry in f.index, dropping the history of overwrites, re-PUTs, and
+// tombstones that otherwise accumulate without bound across
+// Puts/Deletes/sweeps. It writes to a temp file and renames over the
+// live log, the same crash-safe pattern writeObject uses for objects,
+// so a crash mid-compaction leaves the previous log intact.
+func (f *filesystemStore) compactIndex() error {
+	f.indexMu.Lock()
+	defer f.indexMu.Unlock()
+
+	tmpPath := f.indexPath + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for id, entry := range f.index {
+		var expiresRaw int64
+		if !entry.expiresAt.IsZero() {
+			expiresRaw = entry.expiresAt.Unix()
+		}
+		if _, err := fmt.Fprintf(tmp, "%s\t%s\t%d\n", id, entry.hash, expiresRaw); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, f.indexPath); err != nil {
+		return err
+	}
+
+	newFile, err := os.OpenFile(f.indexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	old := f.idxFile
+	f.idxFile = newFile
+	f.appendsSinceCompact = 0
+	f.dirty = false
+	return old.Close()
+}
+
+func (f *filesystemStore) sweepLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.sweepExpired()
+		case <-f.stopSweep:
+			return
+		}
+	}
+}
+
+func (f *filesystemStore) sweepExpired() {
+	now := time.Now()
+	f.indexMu.RLock()
+	var expired []string
+	for id, entry := range f.index {
+		if !entry.expiresAt.IsZero() && entry.expiresAt.Before(now) {
+			expired = append(expired, id)
+		}
+	}
+	f.indexMu.RUnlock()
+
+	for _, id := range expired {
+		f.writeLock.Lock(id)
+		if err := f.recordIndex(id, "", time.Time{}); err != nil {
+			log.Errorf("store_filesystem: sweeping expired snippet %s: %#v", id, err)
+		}
+		f.writeLock.Unlock(id)
+	}
+}
+
+// Close releases the advisory lock acquired in newFilesystemStore.
+func (f *filesystemStore) Close() error {
+	close(f.stopSweep)
+	f.flushIndex()
+	f.idxFile.Close()
+	if err := unlockFile(f.lockFile); err != nil {
+		f.lockFile.Close()
+		return err
+	}
+	return f.lockFile.Close()
+}
+
+func (f *filesystemStore) objectPath(hash string) string {
+	return filepath.Join(f.objectsPath, hash[:2], hash[2:4], hash)
+}
+
+func (f *filesystemStore) PutSnippet(ctx context.Context, id string, snip *snippet) error {
+	if err := checkBodySize(snip); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(snip.Body)
+	hash := hex.EncodeToString(sum[:])
+
+	if err := f.writeObject(hash, snip.Body); err != nil {
+		return err
+	}
+
+	f.writeLock.Lock(id)
+	defer f.writeLock.Unlock(id)
+	return f.recordIndex(id, hash, snip.ExpiresAt)
+}
+
+func (f *filesystemStore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, _ snippetMeta) error {
+	return f.PutSnippet(ctx, id, snip)
+}
+
+// writeObject compresses body and writes it to the content-addressed
+// object path, skipping the write entirely if an object with this hash
+// already exists on disk (dedup).
+func (f *filesystemStore) writeObject(hash string, body []byte) error {
+	f.objectLock.Lock(hash)
+	defer f.objectLock.Unlock(hash)
+
+	objectPath := f.objectPath(hash)
+	if _, err := os.Stat(objectPath); err == nil {
+		return nil // already stored under this hash
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	format, compressed, err := compressBody(body)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(objectPath), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	header := make([]byte, objectHeaderLen)
+	header[0] = format
+	putUint32(header[1:], crc32.ChecksumIEEE(compressed))
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(compressed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), objectPath)
+}
+
+// compressBody compresses body with zstd, falling back to gzip if a zstd
+// encoder can't be created in this environment.
+func compressBody(body []byte) (format byte, compressed []byte, err error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		var buf strings.Builder
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return 0, nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, nil, err
+		}
+		return formatGzip, []byte(buf.String()), nil
+	}
+	defer enc.Close()
+	return formatZstd, enc.EncodeAll(body, nil), nil
+}
+
+func decompressBody(format byte, compressed []byte) ([]byte, error) {
+	switch format {
+	case formatZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(compressed, nil)
+	case formatGzip:
+		gz, err := gzip.NewReader(strings.NewReader(string(compressed)))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	default:
+		return nil, fmt.Errorf("store_filesystem: unknown compression format %q", format)
+	}
+}
+
+// GetSnippet may still serve a snippet whose ExpiresAt has passed: expiry
+// is only enforced by the hourly sweepExpired, so a snippet can be read
+// for up to an hour after it expires.
+func (f *filesystemStore) GetSnippet(_ context.Context, id string, snip *snippet) error {
+	f.indexMu.RLock()
+	entry, ok := f.index[id]
+	f.indexMu.RUnlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+
+	body, err := f.readObject(entry.hash)
+	if err != nil {
+		return err
+	}
+	snip.Body = body
+	snip.ExpiresAt = entry.expiresAt
+	return nil
+}
+
+func (f *filesystemStore) readObject(hash string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(f.objectPath(hash))
+	if err != nil {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	if len(raw) < objectHeaderLen {
+		log.Errorf("store_filesystem: truncated object %s", hash)
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	format := raw[0]
+	wantCRC := uint32FromBytes(raw[1:objectHeaderLen])
+	compressed := raw[objectHeaderLen:]
+	if crc32.ChecksumIEEE(compressed) != wantCRC {
+		log.Errorf("store_filesystem: corrupt object %s: crc32 mismatch", hash)
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	return decompressBody(format, compressed)
+}
+
+func (f *filesystemStore) DeleteSnippet(_ context.Context, id string) error {
+	f.writeLock.Lock(id)
+	defer f.writeLock.Unlock(id)
+	return f.recordIndex(id, "", time.Time{})
+}
+
+func (f *filesystemStore) IterateSnippets(_ context.Context, fn func(id string, snip *snippet) error) error {
+	f.indexMu.RLock()
+	ids := make([]string, 0, len(f.index))
+	entries := make([]indexEntry, 0, len(f.index))
+	for id, entry := range f.index {
+		ids = append(ids, id)
+		entries = append(entries, entry)
+	}
+	f.indexMu.RUnlock()
+
+	for i, id := range ids {
+		body, err := f.readObject(entries[i].hash)
+		if err != nil {
+			return err
+		}
+		if err := fn(id, &snippet{Body: body, ExpiresAt: entries[i].expiresAt}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact walks the object store and removes any object whose hash is no
+// longer referenced by an id in the index. It's safe to run concurrently
+// with reads and writes, though a freshly written object that hasn't been
+// indexed yet could in principle be collected; callers should run it
+// during low-traffic windows.
+func (f *filesystemStore) Compact() error {
+	f.indexMu.RLock()
+	referenced := make(map[string]bool, len(f.index))
+	for _, entry := range f.index {
+		referenced[entry.hash] = true
+	}
+	f.indexMu.RUnlock()
+
+	return filepath.Walk(f.objectsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		hash := filepath.Base(path)
+		if referenced[hash] || strings.HasPrefix(hash, "tmp-") {
+			return nil // live object, or writeObject's in-progress temp file
+		}
+		f.objectLock.Lock(hash)
+		defer f.objectLock.Unlock(hash)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
+
+func uint32FromBytes(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+var _ io.Closer = (*filesystemStore)(nil)
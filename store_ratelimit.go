@@ -0,0 +1,123 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	putRateLimit = flag.Float64("put-rate-limit", 1,
+		"maximum PutSnippet calls per second allowed from a single remote IP; 0 disables rate limiting")
+	putRateBurst = flag.Int("put-rate-burst", 5,
+		"burst size for -put-rate-limit")
+)
+
+// idleLimiterTTL is how long a per-IP limiter can go unused before
+// idleLimiterSweepInterval reclaims it.
+const (
+	idleLimiterTTL           = 10 * time.Minute
+	idleLimiterSweepInterval = 10 * time.Minute
+)
+
+// ErrRateLimited is returned by PutSnippetWithMeta when the calling IP has
+// exceeded its quota.
+var ErrRateLimited = errors.New("store: too many snippets from this IP, please slow down")
+
+// abuseLimitStore wraps a store and rejects PutSnippetWithMeta calls from
+// remote IPs that are creating snippets faster than its rate limit
+// allows, so a single prolific abuser can be rejected before it ever
+// reaches the backend store. PutSnippet (without meta) passes through
+// unlimited, since it has no IP to key on.
+type abuseLimitStore struct {
+	store
+
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	stopSweep chan struct{}
+}
+
+// limiterEntry pairs a per-IP limiter with the last time it was used, so
+// idle entries can be reclaimed instead of growing the map forever as
+// abusers cycle through source IPs.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// newAbuseLimitStore wraps backend with a per-IP PutSnippet rate limiter
+// of limit events/sec and the given burst. A limit of 0 disables
+// limiting and returns backend unchanged.
+func newAbuseLimitStore(backend store, limit float64, burst int) store {
+	if limit <= 0 {
+		return backend
+	}
+	a := &abuseLimitStore{
+		store:     backend,
+		limit:     rate.Limit(limit),
+		burst:     burst,
+		limiters:  map[string]*limiterEntry{},
+		stopSweep: make(chan struct{}),
+	}
+	go a.sweepLoop()
+	return a
+}
+
+func (a *abuseLimitStore) sweepLoop() {
+	ticker := time.NewTicker(idleLimiterSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.sweepIdle()
+		case <-a.stopSweep:
+			return
+		}
+	}
+}
+
+func (a *abuseLimitStore) sweepIdle() {
+	cutoff := time.Now().Add(-idleLimiterTTL)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ip, e := range a.limiters {
+		if e.lastUsed.Before(cutoff) {
+			delete(a.limiters, ip)
+		}
+	}
+}
+
+func (a *abuseLimitStore) limiterFor(ip string) *rate.Limiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.limiters[ip]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(a.limit, a.burst)}
+		a.limiters[ip] = e
+	}
+	e.lastUsed = time.Now()
+	return e.limiter
+}
+
+func (a *abuseLimitStore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, meta snippetMeta) error {
+	if meta.RemoteIP != "" && !a.limiterFor(meta.RemoteIP).Allow() {
+		return ErrRateLimited
+	}
+	return a.store.PutSnippetWithMeta(ctx, id, snip, meta)
+}
+
+func (a *abuseLimitStore) Close() error {
+	close(a.stopSweep)
+	return a.store.Close()
+}
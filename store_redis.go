@@ -0,0 +1,107 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	redisAddr = flag.String("redis-addr", envOr("PLAYGROUND_REDIS_ADDR", "localhost:6379"),
+		"address of the redis server used by -store=redis")
+	redisTTL = flag.Duration("redis-ttl", 0,
+		"TTL applied to snippets stored in redis; 0 means no expiration")
+)
+
+// redisStore is a store backed by redis, keyed by snippet ID. Puts use
+// SET NX so an existing snippet is never overwritten; since playground
+// ids are content-derived, a re-PUT of an existing id is just a resubmit
+// of the same snippet and is treated as an idempotent success.
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisStore() (*redisStore, error) {
+	client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &redisStore{client: client, ttl: *redisTTL}, nil
+}
+
+func (s *redisStore) PutSnippet(ctx context.Context, id string, snip *snippet) error {
+	if err := checkBodySize(snip); err != nil {
+		return err
+	}
+
+	ttl := s.ttl
+	if !snip.ExpiresAt.IsZero() {
+		until := time.Until(snip.ExpiresAt)
+		if until <= 0 {
+			// Already expired: nothing to store, and Redis rejects a
+			// negative expire with "invalid expire time" anyway.
+			return nil
+		}
+		if ttl == 0 || until < ttl {
+			ttl = until
+		}
+	}
+
+	// Playground ids are content-derived, so a re-PUT of an id that's
+	// already set is just the same snippet being shared again: treat it
+	// as an idempotent success, matching the other backends.
+	if _, err := s.client.SetNX(ctx, id, snip.Body, ttl).Result(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *redisStore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, _ snippetMeta) error {
+	return s.PutSnippet(ctx, id, snip)
+}
+
+func (s *redisStore) GetSnippet(ctx context.Context, id string, snip *snippet) error {
+	body, err := s.client.Get(ctx, id).Bytes()
+	if err == redis.Nil {
+		return datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return err
+	}
+	snip.Body = body
+	return nil
+}
+
+func (s *redisStore) DeleteSnippet(ctx context.Context, id string) error {
+	return s.client.Del(ctx, id).Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStore) IterateSnippets(ctx context.Context, fn func(id string, snip *snippet) error) error {
+	iter := s.client.Scan(ctx, 0, "", 0).Iterator()
+	for iter.Next(ctx) {
+		id := iter.Val()
+		var snip snippet
+		if err := s.GetSnippet(ctx, id, &snip); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				continue // deleted between SCAN and GET
+			}
+			return err
+		}
+		if err := fn(id, &snip); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
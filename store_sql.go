@@ -0,0 +1,193 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var (
+	sqlDriver = flag.String("sql-driver", envOr("PLAYGROUND_SQL_DRIVER", "sqlite3"),
+		"database/sql driver name used by -store=sql: postgres, mysql, or sqlite3")
+	sqlDSN = flag.String("sql-dsn", envOr("PLAYGROUND_SQL_DSN", "./snippet.db"),
+		"data source name (DSN) passed to the -sql-driver")
+)
+
+// sqlStore is a store backed by database/sql. Postgres, MySQL, and SQLite
+// each need their own schema (body column type, placeholder syntax, and
+// upsert clause), so sqlStore picks the right query set once at
+// construction time rather than pretending one dialect-neutral query
+// works everywhere.
+type sqlStore struct {
+	db        *sql.DB
+	queries   sqlQueries
+	stopSweep chan struct{}
+}
+
+// sqlQueries holds the dialect-specific SQL for one driver.
+type sqlQueries struct {
+	schema       string
+	upsert       string // id, body, created_at, expires_at
+	selectBody   string // id
+	delete       string // id
+	sweepExpired string // now (unix seconds)
+	selectAll    string // no args
+}
+
+var sqlDialects = map[string]sqlQueries{
+	"postgres": {
+		schema: `
+CREATE TABLE IF NOT EXISTS snippets (
+	id         VARCHAR(255) PRIMARY KEY,
+	body       BYTEA NOT NULL,
+	created_at BIGINT NOT NULL DEFAULT 0,
+	expires_at BIGINT NOT NULL DEFAULT 0
+)`,
+		upsert: `INSERT INTO snippets (id, body, created_at, expires_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (id) DO UPDATE SET body = EXCLUDED.body, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at`,
+		selectBody:   `SELECT body FROM snippets WHERE id = $1`,
+		delete:       `DELETE FROM snippets WHERE id = $1`,
+		sweepExpired: `DELETE FROM snippets WHERE expires_at > 0 AND expires_at <= $1`,
+		selectAll:    `SELECT id, body FROM snippets`,
+	},
+	"mysql": {
+		// LONGBLOB, not BLOB: BLOB caps at 65,535 bytes, well under the
+		// default -max-body-bytes of 1<<20.
+		schema: `
+CREATE TABLE IF NOT EXISTS snippets (
+	id         VARCHAR(255) PRIMARY KEY,
+	body       LONGBLOB NOT NULL,
+	created_at BIGINT NOT NULL DEFAULT 0,
+	expires_at BIGINT NOT NULL DEFAULT 0
+)`,
+		upsert: `INSERT INTO snippets (id, body, created_at, expires_at) VALUES (?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE body = VALUES(body), created_at = VALUES(created_at), expires_at = VALUES(expires_at)`,
+		selectBody:   `SELECT body FROM snippets WHERE id = ?`,
+		delete:       `DELETE FROM snippets WHERE id = ?`,
+		sweepExpired: `DELETE FROM snippets WHERE expires_at > 0 AND expires_at <= ?`,
+		selectAll:    `SELECT id, body FROM snippets`,
+	},
+	"sqlite3": {
+		schema: `
+CREATE TABLE IF NOT EXISTS snippets (
+	id         VARCHAR(255) PRIMARY KEY,
+	body       BLOB NOT NULL,
+	created_at BIGINT NOT NULL DEFAULT 0,
+	expires_at BIGINT NOT NULL DEFAULT 0
+)`,
+		upsert:       `INSERT OR REPLACE INTO snippets (id, body, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		selectBody:   `SELECT body FROM snippets WHERE id = ?`,
+		delete:       `DELETE FROM snippets WHERE id = ?`,
+		sweepExpired: `DELETE FROM snippets WHERE expires_at > 0 AND expires_at <= ?`,
+		selectAll:    `SELECT id, body FROM snippets`,
+	},
+}
+
+func newSQLStore() (*sqlStore, error) {
+	queries, ok := sqlDialects[*sqlDriver]
+	if !ok {
+		return nil, fmt.Errorf("store_sql: unsupported -sql-driver %q: want postgres, mysql, or sqlite3", *sqlDriver)
+	}
+
+	db, err := sql.Open(*sqlDriver, *sqlDSN)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s database: %v", *sqlDriver, err)
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("connecting to %s database: %v", *sqlDriver, err)
+	}
+	if _, err := db.Exec(queries.schema); err != nil {
+		return nil, fmt.Errorf("migrating snippets table: %v", err)
+	}
+
+	s := &sqlStore{db: db, queries: queries, stopSweep: make(chan struct{})}
+	go s.sweepLoop()
+	return s, nil
+}
+
+func (s *sqlStore) sweepLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.db.Exec(s.queries.sweepExpired, time.Now().Unix()); err != nil {
+				log.Errorf("store_sql: sweeping expired snippets: %#v", err)
+			}
+		case <-s.stopSweep:
+			return
+		}
+	}
+}
+
+// PutSnippet upserts, since playground ids are content-derived and a
+// resubmit of an already-stored id must succeed idempotently, matching
+// cloudDatastore and inMemStore.
+func (s *sqlStore) PutSnippet(ctx context.Context, id string, snip *snippet) error {
+	if err := checkBodySize(snip); err != nil {
+		return err
+	}
+
+	createdAt := snip.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	var expiresAt int64
+	if !snip.ExpiresAt.IsZero() {
+		expiresAt = snip.ExpiresAt.Unix()
+	}
+
+	_, err := s.db.ExecContext(ctx, s.queries.upsert, id, snip.Body, createdAt.Unix(), expiresAt)
+	return err
+}
+
+func (s *sqlStore) PutSnippetWithMeta(ctx context.Context, id string, snip *snippet, _ snippetMeta) error {
+	return s.PutSnippet(ctx, id, snip)
+}
+
+func (s *sqlStore) GetSnippet(ctx context.Context, id string, snip *snippet) error {
+	row := s.db.QueryRowContext(ctx, s.queries.selectBody, id)
+	if err := row.Scan(&snip.Body); err == sql.ErrNoRows {
+		return datastore.ErrNoSuchEntity
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteSnippet(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.queries.delete, id)
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	close(s.stopSweep)
+	return s.db.Close()
+}
+
+func (s *sqlStore) IterateSnippets(ctx context.Context, fn func(id string, snip *snippet) error) error {
+	rows, err := s.db.QueryContext(ctx, s.queries.selectAll)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var snip snippet
+		if err := rows.Scan(&id, &snip.Body); err != nil {
+			return err
+		}
+		if err := fn(id, &snip); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}